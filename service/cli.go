@@ -0,0 +1,367 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/Microsoft/go-winio"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+const (
+	serviceName        = "OpenFortiVPNWSLProxy"
+	serviceDisplayName = "OpenFortiVPN WSL Proxy"
+	namedPipePath      = `\\.\pipe\openfortivpn-wsl-proxy`
+	statusDialTimeout  = 2 * time.Second
+)
+
+// runFlags returns the flags shared by any command that resolves and runs a
+// config (run, install-service). They're registered on App.Flags too (main
+// passes runFlags() as App.Flags) so the no-subcommand invocation keeps working, but each
+// command also needs its own copy: urfave/cli only recognizes a flag on the
+// FlagSet it's registered against, and positional <config.yaml> on "run"
+// means a flag known only at the app level stops parsing cleanly once it
+// trails the positional arg.
+func runFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{Name: "config", Aliases: []string{"c"}, Usage: "path to the YAML config (fallback when <config> is not given positionally)"},
+		&cli.StringFlag{Name: "distro", Value: defaultDistro, Usage: "WSL distro name to run the VPN binary in"},
+		&cli.StringFlag{Name: "vpn-binary", Value: defaultVPNBinary, Usage: "path to run-vpn inside the distro"},
+		&cli.DurationFlag{Name: "startup-grace", Value: defaultStartupGrace, Usage: "how long to wait for an early WSL exit before considering startup successful"},
+		&cli.BoolFlag{Name: "no-open-browser", Usage: "don't auto-open the detected authentication URL"},
+		&cli.IntFlag{Name: "retry-limit", Value: defaultRetryLimit, Usage: "max consecutive WSL process restarts when running as a Windows service; the count resets after each successful start (0 = unlimited)"},
+		&cli.StringFlag{Name: "profile", Usage: "profile name to use, required if the config defines a profiles: map"},
+		&cli.StringFlag{Name: "log-level", Value: "info", Usage: "trace|debug|info|warn|error"},
+		&cli.StringFlag{Name: "log-format", Value: "text", Usage: "text|json"},
+		&cli.StringFlag{Name: "log-file", Usage: "write logs to this file (rotated via lumberjack) instead of stderr"},
+	}
+}
+
+func runOptsFromContext(c *cli.Context) runOpts {
+	return runOpts{
+		Distro:        c.String("distro"),
+		VPNBinary:     c.String("vpn-binary"),
+		StartupGrace:  c.Duration("startup-grace"),
+		NoOpenBrowser: c.Bool("no-open-browser"),
+		RetryLimit:    c.Int("retry-limit"),
+		Profile:       c.String("profile"),
+	}
+}
+
+func logConfigFromContext(c *cli.Context) LogConfig {
+	return LogConfig{Level: c.String("log-level"), Format: c.String("log-format"), File: c.String("log-file")}
+}
+
+// resolveConfigPath accepts the config path either positionally (the
+// original invocation style) or via the global --config flag.
+func resolveConfigPath(c *cli.Context) (string, error) {
+	if c.Args().Len() > 0 {
+		return c.Args().First(), nil
+	}
+	if cfg := c.String("config"); cfg != "" {
+		return cfg, nil
+	}
+	return "", fmt.Errorf("config path required: pass it as an argument or with --config")
+}
+
+var runCommand = &cli.Command{
+	Name:      "run",
+	Usage:     "run the proxy: apply DNS routing and supervise the WSL VPN process",
+	ArgsUsage: "<config.yaml>",
+	Flags: append(runFlags(), &cli.BoolFlag{
+		Name: "dns-proxy-only", Usage: "skip addDNSRule/removeDNSRule entirely and just run the DNS proxy",
+	}),
+	Action: func(c *cli.Context) error {
+		path, err := resolveConfigPath(c)
+		if err != nil {
+			return err
+		}
+		opts := runOptsFromContext(c)
+		opts.DNSProxyOnly = c.Bool("dns-proxy-only")
+		logCfg := logConfigFromContext(c)
+
+		isService, err := svc.IsWindowsService()
+		if err != nil {
+			return fmt.Errorf("determine session type: %w", err)
+		}
+		if isService {
+			return runAsService(path, opts, logCfg)
+		}
+		return run(path, opts, logCfg)
+	},
+}
+
+var validateCommand = &cli.Command{
+	Name:      "validate",
+	Usage:     "load and validate a config file, then exit",
+	ArgsUsage: "<config.yaml>",
+	Flags: []cli.Flag{
+		&cli.StringFlag{Name: "config", Aliases: []string{"c"}, Usage: "path to the YAML config (fallback when <config> is not given positionally)"},
+		&cli.StringFlag{Name: "profile", Usage: "profile name to use, required if the config defines a profiles: map"},
+	},
+	Action: func(c *cli.Context) error {
+		path, err := resolveConfigPath(c)
+		if err != nil {
+			return err
+		}
+		svc := &myService{yamlPath: path, opts: runOpts{Profile: c.String("profile")}}
+		if err := svc.loadConfig(); err != nil {
+			return fmt.Errorf("load config: %w", err)
+		}
+		if err := svc.validateConfig(); err != nil {
+			return err
+		}
+		fmt.Println("config is valid")
+		return nil
+	},
+}
+
+var installServiceCommand = &cli.Command{
+	Name:      "install-service",
+	Usage:     "register this binary as a Windows service",
+	ArgsUsage: "<config.yaml>",
+	Flags:     runFlags(),
+	Action: func(c *cli.Context) error {
+		path, err := resolveConfigPath(c)
+		if err != nil {
+			return err
+		}
+		exePath, err := os.Executable()
+		if err != nil {
+			return fmt.Errorf("resolve executable path: %w", err)
+		}
+
+		m, err := mgr.Connect()
+		if err != nil {
+			return fmt.Errorf("connect to service manager: %w", err)
+		}
+		defer m.Disconnect()
+
+		if existing, err := m.OpenService(serviceName); err == nil {
+			existing.Close()
+			return fmt.Errorf("service %s is already installed", serviceName)
+		}
+
+		s, err := m.CreateService(serviceName, exePath, mgr.Config{
+			DisplayName: serviceDisplayName,
+			StartType:   mgr.StartAutomatic,
+		}, serviceArgs(c, path)...)
+		if err != nil {
+			return fmt.Errorf("create service: %w", err)
+		}
+		defer s.Close()
+
+		if err := eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: failed to register event log source: %v\n", err)
+		}
+
+		fmt.Printf("service %s installed (config: %s)\n", serviceName, path)
+		return nil
+	},
+}
+
+var uninstallServiceCommand = &cli.Command{
+	Name:  "uninstall-service",
+	Usage: "unregister the Windows service",
+	Action: func(c *cli.Context) error {
+		m, err := mgr.Connect()
+		if err != nil {
+			return fmt.Errorf("connect to service manager: %w", err)
+		}
+		defer m.Disconnect()
+
+		s, err := m.OpenService(serviceName)
+		if err != nil {
+			return fmt.Errorf("service %s is not installed: %w", serviceName, err)
+		}
+		defer s.Close()
+
+		if err := s.Delete(); err != nil {
+			return fmt.Errorf("delete service: %w", err)
+		}
+		_ = eventlog.Remove(serviceName)
+
+		fmt.Printf("service %s uninstalled\n", serviceName)
+		return nil
+	},
+}
+
+// sendPipeCommand sends a single command line to the running instance's
+// named pipe and returns its one-line response.
+func sendPipeCommand(cmd string) (string, error) {
+	conn, err := winio.DialPipe(namedPipePath, durationPtr(statusDialTimeout))
+	if err != nil {
+		return "", fmt.Errorf("not running (no response on %s): %w", namedPipePath, err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(cmd + "\n")); err != nil {
+		return "", fmt.Errorf("write request: %w", err)
+	}
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return "", fmt.Errorf("read response: %w", err)
+	}
+	return string(buf[:n]), nil
+}
+
+var statusCommand = &cli.Command{
+	Name:  "status",
+	Usage: "query a running instance over its named pipe",
+	Action: func(c *cli.Context) error {
+		resp, err := sendPipeCommand("status")
+		if err != nil {
+			return err
+		}
+		fmt.Print(resp)
+		return nil
+	},
+}
+
+var reloadCommand = &cli.Command{
+	Name:  "reload",
+	Usage: "ask a running instance to re-read its config over the named pipe",
+	Action: func(c *cli.Context) error {
+		resp, err := sendPipeCommand("reload")
+		if err != nil {
+			return err
+		}
+		fmt.Print(resp)
+		return nil
+	},
+}
+
+var profilesCommand = &cli.Command{
+	Name:  "profiles",
+	Usage: "manage multi-profile configs on a running instance",
+	Subcommands: []*cli.Command{
+		{
+			Name:      "switch",
+			Usage:     "atomically reconnect to a different profile's VPN endpoint",
+			ArgsUsage: "<profile-name>",
+			Action: func(c *cli.Context) error {
+				if c.Args().Len() != 1 {
+					return fmt.Errorf("usage: profiles switch <profile-name>")
+				}
+				resp, err := sendPipeCommand("switch-profile " + c.Args().First())
+				if err != nil {
+					return err
+				}
+				fmt.Print(resp)
+				return nil
+			},
+		},
+	},
+}
+
+var dnsCommand = &cli.Command{
+	Name:  "dns",
+	Usage: "inspect or clean up NRPT rules created by this tool",
+	Subcommands: []*cli.Command{
+		{
+			Name:  "rules",
+			Usage: "manage the NRPT rule left by a (possibly crashed) instance",
+			Subcommands: []*cli.Command{
+				{
+					Name:  "list",
+					Usage: "show the current NRPT rule, if any",
+					Action: func(c *cli.Context) error {
+						psCmd := fmt.Sprintf(`Get-DnsClientNrptRule | Where-Object { $_.DisplayName -eq '%s' } | Format-List`, dnsRuleDisplayName)
+						output, err := exec.Command("powershell", "-Command", psCmd).CombinedOutput()
+						if err != nil {
+							return fmt.Errorf("list DNS rules: %w (output: %s)", err, output)
+						}
+						fmt.Print(string(output))
+						return nil
+					},
+				},
+				{
+					Name:  "clear",
+					Usage: "remove the NRPT rule, even if the instance that created it has crashed",
+					Action: func(c *cli.Context) error {
+						output, err := removeNRPTRule(dnsRuleDisplayName)
+						if err != nil {
+							return fmt.Errorf("clear DNS rules: %w (output: %s)", err, output)
+						}
+						fmt.Println("NRPT rule cleared")
+						return nil
+					},
+				},
+			},
+		},
+	},
+}
+
+// serviceArgs builds the binPath arguments the SCM will invoke on every
+// start, forwarding whichever flags the operator passed to install-service
+// so the service runs with the same settings (profile, distro, retry limit,
+// logging, ...) as the interactive invocation that registered it. Flags are
+// emitted before the positional config path: "run" stops parsing flags at
+// the first positional argument, so anything after path would be treated as
+// a leftover arg instead of being applied.
+func serviceArgs(c *cli.Context, path string) []string {
+	args := []string{"run"}
+	if c.IsSet("profile") {
+		args = append(args, "--profile", c.String("profile"))
+	}
+	if c.IsSet("distro") {
+		args = append(args, "--distro", c.String("distro"))
+	}
+	if c.IsSet("vpn-binary") {
+		args = append(args, "--vpn-binary", c.String("vpn-binary"))
+	}
+	if c.IsSet("startup-grace") {
+		args = append(args, "--startup-grace", c.Duration("startup-grace").String())
+	}
+	if c.Bool("no-open-browser") {
+		args = append(args, "--no-open-browser")
+	}
+	if c.IsSet("retry-limit") {
+		args = append(args, "--retry-limit", strconv.Itoa(c.Int("retry-limit")))
+	}
+	if c.IsSet("log-level") {
+		args = append(args, "--log-level", c.String("log-level"))
+	}
+	if c.IsSet("log-format") {
+		args = append(args, "--log-format", c.String("log-format"))
+	}
+	if c.IsSet("log-file") {
+		args = append(args, "--log-file", c.String("log-file"))
+	}
+	args = append(args, path)
+	return args
+}
+
+func durationPtr(d time.Duration) *time.Duration { return &d }
+
+func main() {
+	app := &cli.App{
+		Name:  "openfortivpn-wsl-proxy",
+		Usage: "Run OpenFortiVPN inside WSL and bridge its DNS routing to Windows",
+		Flags: runFlags(),
+		Commands: []*cli.Command{
+			runCommand,
+			validateCommand,
+			installServiceCommand,
+			uninstallServiceCommand,
+			statusCommand,
+			reloadCommand,
+			profilesCommand,
+			dnsCommand,
+		},
+		// Preserve the original `openfortivpn-wsl-proxy <config.yaml>` invocation.
+		Action: runCommand.Action,
+	}
+
+	if err := app.Run(os.Args); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultDNSProxyListen  = "127.0.0.1:53"
+	dnsUpstreamDialTimeout = 3 * time.Second
+	dnsUpstreamReadTimeout = 5 * time.Second
+)
+
+// DNSProxyConfig is the `dns_proxy:` block in the YAML config. When present,
+// run() starts an in-process resolver that answers queries locally instead
+// of (or in addition to) the NRPT rule installed via addDNSRule.
+type DNSProxyConfig struct {
+	Listen              string         `yaml:"listen"`
+	FallbackNameservers []string       `yaml:"fallback_nameservers"`
+	Rules               []DNSProxyRule `yaml:"rules"`
+}
+
+// DNSProxyRule overrides the upstream resolver for a domain suffix. Suffix
+// matching is longest-match-wins, mirroring NRPT namespace precedence.
+type DNSProxyRule struct {
+	Suffix      string   `yaml:"suffix"`
+	Nameservers []string `yaml:"nameservers"`
+}
+
+// dnsRouter picks an upstream nameserver list for a query name by
+// longest-suffix match, falling back to the configured fallback resolvers.
+type dnsRouter struct {
+	rules    []DNSProxyRule
+	fallback []string
+}
+
+// newDNSRouter builds a router from the explicit dns_proxy.rules plus an
+// implicit rule derived from the top-level Domains/Nameservers split-horizon
+// config, so dns_proxy "just works" without duplicating the domain list.
+func newDNSRouter(cfg *DNSProxyConfig, domains, nameservers []string) *dnsRouter {
+	r := &dnsRouter{fallback: cfg.FallbackNameservers}
+	r.rules = append(r.rules, cfg.Rules...)
+	if len(nameservers) > 0 {
+		for _, d := range domains {
+			r.rules = append(r.rules, DNSProxyRule{Suffix: d, Nameservers: nameservers})
+		}
+	}
+	return r
+}
+
+func (r *dnsRouter) resolve(qname string) []string {
+	qname = strings.ToLower(strings.TrimSuffix(qname, "."))
+	best := -1
+	var ns []string
+	for _, rule := range r.rules {
+		suffix := strings.ToLower(strings.TrimPrefix(rule.Suffix, "."))
+		if suffix == "" {
+			continue
+		}
+		if qname != suffix && !strings.HasSuffix(qname, "."+suffix) {
+			continue
+		}
+		if len(suffix) > best {
+			best = len(suffix)
+			ns = rule.Nameservers
+		}
+	}
+	if ns == nil {
+		return r.fallback
+	}
+	return ns
+}
+
+// upstreamPool keeps one dns.Client per transport (UDP/TCP) so the client
+// and its dial/read/write timeouts are reused across queries instead of
+// being rebuilt on every exchange. dns.Client.Exchange takes the upstream
+// address per call, so there's no per-address state to pool - one client
+// per protocol is enough.
+type upstreamPool struct {
+	mu      sync.Mutex
+	clients map[string]*dns.Client
+}
+
+func newUpstreamPool() *upstreamPool {
+	return &upstreamPool{clients: make(map[string]*dns.Client)}
+}
+
+func (p *upstreamPool) client(net string) *dns.Client {
+	key := net
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if c, ok := p.clients[key]; ok {
+		return c
+	}
+	c := &dns.Client{
+		Net:          net,
+		DialTimeout:  dnsUpstreamDialTimeout,
+		ReadTimeout:  dnsUpstreamReadTimeout,
+		WriteTimeout: dnsUpstreamReadTimeout,
+	}
+	p.clients[key] = c
+	return c
+}
+
+// DNSProxy is a small UDP+TCP resolver that forwards queries to per-domain
+// upstreams selected by dnsRouter, falling back to the configured
+// fallback_nameservers. A query with no matching rule and no fallback
+// nameservers gets SERVFAIL.
+type DNSProxy struct {
+	mu     sync.Mutex
+	router *dnsRouter
+	pool   *upstreamPool
+	log    hclog.Logger
+
+	udpSrv *dns.Server
+	tcpSrv *dns.Server
+}
+
+func newDNSProxy(cfg *DNSProxyConfig, domains, nameservers []string, logger hclog.Logger) *DNSProxy {
+	return &DNSProxy{
+		router: newDNSRouter(cfg, domains, nameservers),
+		pool:   newUpstreamPool(),
+		log:    logger,
+	}
+}
+
+// updateRouter rebuilds the router from a new config without restarting the
+// UDP/TCP listeners, so "reload" can pick up changed domains, nameservers,
+// or dns_proxy.rules in place.
+func (p *DNSProxy) updateRouter(cfg *DNSProxyConfig, domains, nameservers []string) {
+	if cfg == nil {
+		cfg = &DNSProxyConfig{}
+	}
+	router := newDNSRouter(cfg, domains, nameservers)
+	p.mu.Lock()
+	p.router = router
+	p.mu.Unlock()
+}
+
+func (p *DNSProxy) handle(w dns.ResponseWriter, req *dns.Msg) {
+	if len(req.Question) == 0 {
+		dns.HandleFailed(w, req)
+		return
+	}
+	p.mu.Lock()
+	router := p.router
+	p.mu.Unlock()
+
+	upstreams := router.resolve(req.Question[0].Name)
+	netProto := "udp"
+	if _, ok := w.RemoteAddr().(*net.TCPAddr); ok {
+		netProto = "tcp"
+	}
+	client := p.pool.client(netProto)
+
+	for _, addr := range upstreams {
+		addr = ensurePort(addr)
+		resp, _, err := client.Exchange(req, addr)
+		if err != nil {
+			p.log.Warn("dns-proxy upstream failed", "upstream", addr, "qname", req.Question[0].Name, "error", err)
+			continue
+		}
+		_ = w.WriteMsg(resp)
+		return
+	}
+	dns.HandleFailed(w, req)
+}
+
+func ensurePort(addr string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(addr, "53")
+}
+
+// Start brings up the UDP and TCP listeners and returns once both are ready
+// to serve, or an error if either failed to bind.
+func (p *DNSProxy) Start(listen string) error {
+	if listen == "" {
+		listen = defaultDNSProxyListen
+	}
+
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", p.handle)
+
+	p.udpSrv = &dns.Server{Addr: listen, Net: "udp", Handler: mux}
+	p.tcpSrv = &dns.Server{Addr: listen, Net: "tcp", Handler: mux}
+
+	readyCh := make(chan error, 2)
+	p.udpSrv.NotifyStartedFunc = func() { readyCh <- nil }
+	p.tcpSrv.NotifyStartedFunc = func() { readyCh <- nil }
+
+	go func() {
+		if err := p.udpSrv.ListenAndServe(); err != nil {
+			readyCh <- fmt.Errorf("dns-proxy udp: %w", err)
+		}
+	}()
+	go func() {
+		if err := p.tcpSrv.ListenAndServe(); err != nil {
+			readyCh <- fmt.Errorf("dns-proxy tcp: %w", err)
+		}
+	}()
+
+	for i := 0; i < 2; i++ {
+		if err := <-readyCh; err != nil {
+			p.Stop()
+			return err
+		}
+	}
+	p.log.Info("dns-proxy listening", "addr", listen, "proto", "udp+tcp")
+	return nil
+}
+
+// Stop shuts down both listeners. Safe to call even if Start failed partway.
+func (p *DNSProxy) Stop() {
+	if p.udpSrv != nil {
+		_ = p.udpSrv.Shutdown()
+	}
+	if p.tcpSrv != nil {
+		_ = p.tcpSrv.Shutdown()
+	}
+}
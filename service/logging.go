@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/hashicorp/go-hclog"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// LogConfig holds the --log-level/--log-format/--log-file flag values used
+// to build the process-wide hclog.Logger.
+type LogConfig struct {
+	Level  string
+	Format string
+	File   string
+}
+
+// newLogger builds the root logger per LogConfig. JSON output is the
+// expected format for Windows Event Log forwarders and log-aggregation
+// pipelines; text is the default for interactive use.
+func newLogger(cfg LogConfig) (hclog.Logger, error) {
+	level := hclog.LevelFromString(cfg.Level)
+	if level == hclog.NoLevel {
+		return nil, fmt.Errorf("invalid --log-level %q", cfg.Level)
+	}
+
+	var writer io.Writer = os.Stderr
+	if cfg.File != "" {
+		writer = &lumberjack.Logger{
+			Filename:   cfg.File,
+			MaxSize:    10, // megabytes
+			MaxBackups: 5,
+			MaxAge:     28, // days
+		}
+	}
+
+	var jsonFormat bool
+	switch cfg.Format {
+	case "", "text":
+		jsonFormat = false
+	case "json":
+		jsonFormat = true
+	default:
+		return nil, fmt.Errorf("invalid --log-format %q (want text or json)", cfg.Format)
+	}
+
+	return hclog.New(&hclog.LoggerOptions{
+		Name:       "openfortivpn-wsl-proxy",
+		Level:      level,
+		Output:     writer,
+		JSONFormat: jsonFormat,
+	}), nil
+}
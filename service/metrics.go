@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const defaultReadySuccessRegex = `(?i)tunnel is up`
+
+var tunnelUpRe = regexp.MustCompile(`(?i)tunnel is up`)
+
+// MetricsConfig is the `metrics:` block in the YAML config. When present,
+// run() starts an HTTP server exposing /metrics, /healthz, and /readyz.
+type MetricsConfig struct {
+	Listen            string `yaml:"listen"`
+	ReadySuccessRegex string `yaml:"ready_success_regex"`
+}
+
+// metricsServer owns the Prometheus registry, the /healthz+/readyz state
+// machine, and the HTTP server that exposes all three.
+type metricsServer struct {
+	reg *prometheus.Registry
+	log hclog.Logger
+
+	up              prometheus.Gauge
+	restartsTotal   prometheus.Counter
+	streamBytes     *prometheus.CounterVec
+	authURLOpened   prometheus.Counter
+	dnsRuleActive   prometheus.Gauge
+	connectDuration prometheus.Histogram
+
+	successRe *regexp.Regexp
+
+	mu            sync.Mutex
+	wslExitCh     chan struct{}
+	connectStart  time.Time
+	authConsumed  bool
+	successSeen   bool
+
+	srv *http.Server
+}
+
+func newMetricsServer(cfg *MetricsConfig, logger hclog.Logger) (*metricsServer, error) {
+	pattern := cfg.ReadySuccessRegex
+	if pattern == "" {
+		pattern = defaultReadySuccessRegex
+	}
+	successRe, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metrics.ready_success_regex: %w", err)
+	}
+
+	reg := prometheus.NewRegistry()
+	ms := &metricsServer{
+		reg:       reg,
+		log:       logger,
+		successRe: successRe,
+		up: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "openfortivpn_up",
+			Help: "1 if the supervised WSL VPN process is currently running, 0 otherwise.",
+		}),
+		restartsTotal: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "openfortivpn_restarts_total",
+			Help: "Number of times the WSL VPN process was restarted after an unexpected exit.",
+		}),
+		streamBytes: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "openfortivpn_wsl_stream_bytes_total",
+			Help: "Bytes logged from the WSL process, by stream.",
+		}, []string{"stream"}),
+		authURLOpened: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "openfortivpn_auth_url_opened_total",
+			Help: "Number of times an authentication URL was detected and handed to the browser opener (counted even when --no-open-browser suppresses the open).",
+		}),
+		dnsRuleActive: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "openfortivpn_dns_rule_active",
+			Help: "1 if the NRPT DNS rule is currently installed, 0 otherwise.",
+		}),
+		connectDuration: promauto.With(reg).NewHistogram(prometheus.HistogramOpts{
+			Name:    "openfortivpn_connect_duration_seconds",
+			Help:    "Time from starting the WSL process until \"Tunnel is up\" was seen in its output.",
+			Buckets: prometheus.DefBuckets,
+		}),
+	}
+	return ms, nil
+}
+
+// Start binds listen and serves /metrics, /healthz, and /readyz until Stop
+// is called. It returns once the listener is bound, so a port conflict or
+// other bind failure surfaces to the caller instead of only showing up in a
+// background goroutine's log line.
+func (ms *metricsServer) Start(listen string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(ms.reg, promhttp.HandlerOpts{}))
+	mux.HandleFunc("/healthz", ms.serveHealthz)
+	mux.HandleFunc("/readyz", ms.serveReadyz)
+
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		return fmt.Errorf("metrics listen: %w", err)
+	}
+
+	ms.srv = &http.Server{Handler: mux}
+	go func() {
+		if err := ms.srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			ms.log.Error("metrics server error", "error", err)
+		}
+	}()
+	ms.log.Info("metrics server listening", "addr", ln.Addr().String())
+	return nil
+}
+
+func (ms *metricsServer) Stop() {
+	if ms.srv == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	_ = ms.srv.Shutdown(ctx)
+}
+
+func (ms *metricsServer) serveHealthz(w http.ResponseWriter, r *http.Request) {
+	ms.mu.Lock()
+	ch := ms.wslExitCh
+	ms.mu.Unlock()
+
+	if ch == nil {
+		http.Error(w, "not started", http.StatusServiceUnavailable)
+		return
+	}
+	select {
+	case <-ch:
+		http.Error(w, "wsl process exited", http.StatusServiceUnavailable)
+	default:
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok"))
+	}
+}
+
+func (ms *metricsServer) serveReadyz(w http.ResponseWriter, r *http.Request) {
+	ms.mu.Lock()
+	ready := ms.authConsumed && ms.successSeen
+	ms.mu.Unlock()
+
+	if !ready {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("ready"))
+}
+
+// setWSLExitCh records the exit channel of the currently supervised WSL
+// process so /healthz can tell whether it's still running.
+func (ms *metricsServer) setWSLExitCh(ch chan struct{}) {
+	ms.mu.Lock()
+	ms.wslExitCh = ch
+	ms.connectStart = time.Now()
+	ms.authConsumed = false
+	ms.successSeen = false
+	ms.mu.Unlock()
+	ms.up.Set(1)
+}
+
+func (ms *metricsServer) markExited() {
+	ms.up.Set(0)
+}
+
+func (ms *metricsServer) markRestarted() {
+	ms.restartsTotal.Inc()
+}
+
+func (ms *metricsServer) markDNSRuleActive(active bool) {
+	if active {
+		ms.dnsRuleActive.Set(1)
+	} else {
+		ms.dnsRuleActive.Set(0)
+	}
+}
+
+func (ms *metricsServer) markAuthURLOpened() {
+	ms.authURLOpened.Inc()
+	ms.mu.Lock()
+	ms.authConsumed = true
+	ms.mu.Unlock()
+}
+
+// observeStreamLine updates byte counters and checks the tunnel-up and
+// readyz-success patterns against a single sanitized WSL output line.
+func (ms *metricsServer) observeStreamLine(stream, line string) {
+	ms.streamBytes.WithLabelValues(stream).Add(float64(len(line)))
+
+	if tunnelUpRe.MatchString(line) {
+		ms.mu.Lock()
+		start := ms.connectStart
+		ms.mu.Unlock()
+		if !start.IsZero() {
+			ms.connectDuration.Observe(time.Since(start).Seconds())
+		}
+	}
+
+	if ms.successRe.MatchString(line) {
+		ms.mu.Lock()
+		ms.successSeen = true
+		ms.mu.Unlock()
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"fmt"
 	"io"
-	"log"
 	"os"
 	"os/exec"
 	"os/signal"
@@ -15,36 +14,137 @@ import (
 	"time"
 	"unicode"
 
+	"github.com/hashicorp/go-hclog"
 	"gopkg.in/yaml.v2"
 )
 
 const (
-	dnsRuleDisplayName = "OpenFortiVPN WSL Proxy"
-	wslStartupGrace    = 5 * time.Second
+	dnsRuleDisplayName  = "OpenFortiVPN WSL Proxy"
+	defaultDistro       = "OpenFortiVPN"
+	defaultVPNBinary    = "/usr/local/bin/run-vpn"
+	defaultStartupGrace = 5 * time.Second
 )
 
 // ANSI escape sequence matcher (CSI and other common forms)
 var ansiSeq = regexp.MustCompile(`\x1b\[[0-9;?]*[ -/]*[@-~]`)
 
 type Config struct {
-	Server      string   `yaml:"server"`
-	Domains     []string `yaml:"domains"`
-	Nameservers []string `yaml:"nameservers"`
+	Server      string          `yaml:"server"`
+	Domains     []string        `yaml:"domains"`
+	Nameservers []string        `yaml:"nameservers"`
+	DNSProxy    *DNSProxyConfig `yaml:"dns_proxy"`
+
+	// Profiles, if set, holds multiple named endpoints in one file (e.g.
+	// "work", "client-a"). The active one is selected at startup via
+	// runOpts.Profile and its fields are merged into the top-level ones
+	// above, so the rest of the code never needs to know profiles exist.
+	Profiles map[string]ProfileConfig `yaml:"profiles"`
+
+	Metrics *MetricsConfig `yaml:"metrics"`
+}
+
+// ProfileConfig is one entry of the `profiles:` map. It mirrors the
+// top-level Config fields that vary per endpoint.
+type ProfileConfig struct {
+	Server      string          `yaml:"server"`
+	Domains     []string        `yaml:"domains"`
+	Nameservers []string        `yaml:"nameservers"`
+	DNSProxy    *DNSProxyConfig `yaml:"dns_proxy"`
+}
+
+// runOpts holds the CLI flags that parameterize a run, as opposed to the
+// YAML config (server/domains/nameservers/dns_proxy).
+type runOpts struct {
+	Distro        string
+	VPNBinary     string
+	StartupGrace  time.Duration
+	NoOpenBrowser bool
+	DNSProxyOnly  bool
+	// RetryLimit bounds how many consecutive times the Windows service will
+	// restart the WSL process after an unexpected exit or a failed start; the
+	// count resets each time the process starts successfully. Zero means
+	// unlimited. Unused outside of service mode.
+	RetryLimit int
+	// Profile selects an entry from Config.Profiles. Required if the config
+	// defines any; ignored otherwise.
+	Profile string
 }
 
 type myService struct {
 	yamlPath  string
 	config    Config
+	log       hclog.Logger
+	opts      runOpts
 	wslCmd    *exec.Cmd
 	wslExitCh chan struct{}
+
+	// onAuthURL, if set, is invoked once with the detected authentication
+	// URL. Used by the Windows service handler to track it for the
+	// named-pipe "reopen-auth" command.
+	onAuthURL func(string)
+
+	// metrics, if set, receives lifecycle and stream events for the
+	// /metrics, /healthz, and /readyz endpoints.
+	metrics *metricsServer
+
+	// proxy, if set, is the in-process DNS proxy started for this instance's
+	// dns_proxy: config. reload() refreshes its router in place so config
+	// changes take effect without restarting the listeners.
+	proxy *DNSProxy
+}
+
+// reopenAuthURL opens the given URL in the default browser, regardless of
+// --no-open-browser. Used by the named-pipe "reopen-auth" control command,
+// which is an explicit user request to reopen it.
+func (m *myService) reopenAuthURL(u string) {
+	_ = exec.Command("rundll32", "url.dll,FileProtocolHandler", u).Start()
+	m.log.Info("reopened authentication URL", "url", u)
 }
 
 func (m *myService) loadConfig() error {
-	data, err := os.ReadFile(m.yamlPath)
+	raw, err := loadRawConfig(m.yamlPath)
 	if err != nil {
 		return err
 	}
-	return yaml.Unmarshal(data, &m.config)
+	cfg, err := resolveProfile(raw, m.opts.Profile)
+	if err != nil {
+		return err
+	}
+	m.config = cfg
+	return nil
+}
+
+// loadRawConfig reads and parses the YAML file without resolving profiles.
+func loadRawConfig(yamlPath string) (Config, error) {
+	data, err := os.ReadFile(yamlPath)
+	if err != nil {
+		return Config{}, err
+	}
+	var raw Config
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return Config{}, err
+	}
+	return raw, nil
+}
+
+// resolveProfile merges the named profile's fields into raw. If raw defines
+// no profiles, it is returned unchanged (the flat, single-endpoint form).
+func resolveProfile(raw Config, profile string) (Config, error) {
+	if len(raw.Profiles) == 0 {
+		return raw, nil
+	}
+	if profile == "" {
+		return Config{}, fmt.Errorf("config defines profiles; select one with --profile")
+	}
+	p, ok := raw.Profiles[profile]
+	if !ok {
+		return Config{}, fmt.Errorf("unknown profile %q", profile)
+	}
+	raw.Server = p.Server
+	raw.Domains = p.Domains
+	raw.Nameservers = p.Nameservers
+	raw.DNSProxy = p.DNSProxy
+	return raw, nil
 }
 
 func (m *myService) validateConfig() error {
@@ -61,32 +161,57 @@ func (m *myService) validateConfig() error {
 }
 
 func (m *myService) addDNSRule() error {
-	if len(m.config.Domains) == 0 || len(m.config.Nameservers) == 0 {
-		return fmt.Errorf("domains or nameservers list is empty")
+	m.removeDNSRule()
+	if err := addNRPTRule(dnsRuleDisplayName, m.config.Domains, m.config.Nameservers); err != nil {
+		m.log.Error("PowerShell error", "error", err)
+		return err
+	}
+	if m.metrics != nil {
+		m.metrics.markDNSRuleActive(true)
 	}
+	return nil
+}
 
-	m.removeDNSRule()
+func (m *myService) removeDNSRule() {
+	if m.opts.DNSProxyOnly {
+		return
+	}
+	if output, err := removeNRPTRule(dnsRuleDisplayName); err != nil {
+		m.log.Error("failed to remove DNS rule", "name", dnsRuleDisplayName, "error", err, "output", string(output))
+	}
+	if m.metrics != nil {
+		m.metrics.markDNSRuleActive(false)
+	}
+}
 
-	domains := strings.Join(m.config.Domains, `","`)
-	nameservers := strings.Join(m.config.Nameservers, `","`)
+// addNRPTRule adds an NRPT rule under the given display name. It does not
+// remove an existing rule of that name first (addDNSRule does that before
+// calling it). Shared by addDNSRule and the
+// "profiles switch" atomic reconnect, which stages a rule under a separate
+// name before promoting it.
+func addNRPTRule(name string, domains, nameservers []string) error {
+	if len(domains) == 0 || len(nameservers) == 0 {
+		return fmt.Errorf("domains or nameservers list is empty")
+	}
 
-	psCmd := fmt.Sprintf(`Add-DnsClientNrptRule -DisplayName '%s' -Namespace @("%s") -NameServers @("%s")`, dnsRuleDisplayName, domains, nameservers)
-	cmd := exec.Command("powershell", "-Command", psCmd)
+	domainsStr := strings.Join(domains, `","`)
+	nameserversStr := strings.Join(nameservers, `","`)
 
-	output, err := cmd.CombinedOutput()
+	psCmd := fmt.Sprintf(`Add-DnsClientNrptRule -DisplayName '%s' -Namespace @("%s") -NameServers @("%s")`, name, domainsStr, nameserversStr)
+	output, err := exec.Command("powershell", "-Command", psCmd).CombinedOutput()
 	if err != nil {
-		log.Printf("PowerShell error: %s", string(output))
-		return fmt.Errorf("failed to add DNS rule: %w", err)
+		return fmt.Errorf("failed to add DNS rule %q: %w (output: %s)", name, err, output)
 	}
 	return nil
 }
 
-func (m *myService) removeDNSRule() {
-	psCmd := fmt.Sprintf(`Get-DnsClientNrptRule | Where-Object { $_.DisplayName -eq '%s' } | Remove-DnsClientNrptRule -Force`, dnsRuleDisplayName)
-	cmd := exec.Command("powershell", "-Command", psCmd)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		log.Printf("Failed to remove DNS rule '%s': %v (output: %s)", dnsRuleDisplayName, err, string(output))
-	}
+// removeNRPTRule deletes any NRPT rule with the given display name. It is
+// also used directly by the "dns rules clear" CLI command, which needs to
+// clean up rules left behind by a crashed instance with no myService/logger
+// around.
+func removeNRPTRule(name string) ([]byte, error) {
+	psCmd := fmt.Sprintf(`Get-DnsClientNrptRule | Where-Object { $_.DisplayName -eq '%s' } | Remove-DnsClientNrptRule -Force`, name)
+	return exec.Command("powershell", "-Command", psCmd).CombinedOutput()
 }
 
 // sanitizeWSL keeps printable runes, strips ANSI (already removed earlier),
@@ -118,7 +243,7 @@ func sanitizeWSL(s string) string {
 
 // streamAndLog processes a reader byte-by-byte, honoring carriage returns as
 // line resets (progress rewrite style). Newlines flush the current buffer.
-func streamAndLog(r io.Reader, prefix string, logLine func(string, string)) {
+func streamAndLog(r io.Reader, prefix string, logger hclog.Logger, logLine func(string, string)) {
 	buf := make([]byte, 4096)
 	var line bytes.Buffer
 	atLineStart := true // track logical start after CR so we can drop clearing spaces
@@ -163,7 +288,7 @@ func streamAndLog(r io.Reader, prefix string, logLine func(string, string)) {
 		}
 		if err != nil {
 			if err != io.EOF {
-				log.Printf("WSL[%s] stream error: %v", prefix, err)
+				logger.Error("WSL stream error", "stream", prefix, "error", err)
 			}
 			break
 		}
@@ -172,7 +297,7 @@ func streamAndLog(r io.Reader, prefix string, logLine func(string, string)) {
 }
 
 func (m *myService) startWSLProcess() error {
-	cmd := exec.Command("wsl", "-d", "OpenFortiVPN", "--", "/usr/local/bin/run-vpn", m.config.Server)
+	cmd := exec.Command("wsl", "-d", m.opts.Distro, "--", m.opts.VPNBinary, m.config.Server)
 	cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
 
 	stdout, err := cmd.StdoutPipe()
@@ -191,18 +316,34 @@ func (m *myService) startWSLProcess() error {
 	authRe := regexp.MustCompile(`Authenticate at '([^']+)'`)
 
 	openAuthURL := func(u string) {
+		if m.metrics != nil {
+			m.metrics.markAuthURLOpened()
+		}
+		if m.opts.NoOpenBrowser {
+			return
+		}
 		_ = exec.Command("rundll32", "url.dll,FileProtocolHandler", u).Start()
-		log.Printf("Opened authentication URL: %s", u)
+		m.log.Info("opened authentication URL", "url", u)
 	}
 
+	streamName := map[string]string{"out": "stdout", "err": "stderr"}
 	logLine := func(prefix, line string) {
-		log.Printf("WSL[%s] %s", prefix, line)
+		m.log.Info("wsl output", "stream", streamName[prefix], "pid", cmd.Process.Pid, "line", line)
+		if m.metrics != nil {
+			m.metrics.observeStreamLine(streamName[prefix], line)
+		}
 		if earlyBuf.Len() < 4096 {
 			earlyBuf.WriteString(prefix + ": " + line + "\n")
 		}
-		if m := authRe.FindStringSubmatch(line); len(m) == 2 {
-			url := m[1]
-			authOnce.Do(func() { openAuthURL(url) })
+		if match := authRe.FindStringSubmatch(line); len(match) == 2 {
+			url := match[1]
+			authOnce.Do(func() {
+				m.log.Info("auth url detected", "event", "auth_url_detected", "url", url)
+				if m.onAuthURL != nil {
+					m.onAuthURL(url)
+				}
+				openAuthURL(url)
+			})
 		}
 	}
 
@@ -212,11 +353,20 @@ func (m *myService) startWSLProcess() error {
 	}
 	m.wslCmd = cmd
 	m.wslExitCh = make(chan struct{})
+	if m.metrics != nil {
+		m.metrics.setWSLExitCh(m.wslExitCh)
+	}
 
-	go streamAndLog(stdout, "out", logLine)
-	go streamAndLog(stderr, "err", logLine)
+	go streamAndLog(stdout, "out", m.log, logLine)
+	go streamAndLog(stderr, "err", m.log, logLine)
 
-	go func() { _ = cmd.Wait(); close(m.wslExitCh) }()
+	go func() {
+		_ = cmd.Wait()
+		close(m.wslExitCh)
+		if m.metrics != nil {
+			m.metrics.markExited()
+		}
+	}()
 
 	select {
 	case <-m.wslExitCh:
@@ -226,13 +376,13 @@ func (m *myService) startWSLProcess() error {
 		}
 		m.removeDNSRule()
 		return fmt.Errorf("WSL process exited prematurely (%s). Initial output:\r\n%s", state, earlyBuf.String())
-	case <-time.After(wslStartupGrace):
+	case <-time.After(m.opts.StartupGrace):
 	}
 	return nil
 }
 
 func (m *myService) stopWSLProcess() {
-	_ = exec.Command("wsl", "--terminate", "OpenFortiVPN").Run()
+	_ = exec.Command("wsl", "--terminate", m.opts.Distro).Run()
 }
 
 func (m *myService) waitWSLExit(timeout time.Duration) {
@@ -242,12 +392,71 @@ func (m *myService) waitWSLExit(timeout time.Duration) {
 	select {
 	case <-m.wslExitCh:
 	case <-time.After(timeout):
-		log.Printf("WSL process did not exit within %s", timeout)
+		m.log.Warn("WSL process did not exit within timeout", "timeout", timeout)
+	}
+}
+
+// reload re-reads the YAML config and applies the delta: a Domains/
+// Nameservers change updates the NRPT rule in place (addDNSRule is
+// idempotent), while a Server change restarts the WSL process. If this
+// instance runs an in-process DNS proxy (m.proxy != nil), its router is
+// always rebuilt from the new config too, since it has no other way to
+// pick up changed domains/nameservers/dns_proxy.rules - including for
+// --dns-proxy-only deployments, where the NRPT rule branch above never
+// runs. Anything else (no-op changes) leaves the tunnel untouched.
+func (m *myService) reload() error {
+	old := m.config
+
+	if err := m.loadConfig(); err != nil {
+		return fmt.Errorf("reload: load config: %w", err)
+	}
+	if err := m.validateConfig(); err != nil {
+		m.config = old
+		return fmt.Errorf("reload: %w", err)
+	}
+
+	if !m.opts.DNSProxyOnly && (!stringSlicesEqual(old.Domains, m.config.Domains) || !stringSlicesEqual(old.Nameservers, m.config.Nameservers)) {
+		if err := m.addDNSRule(); err != nil {
+			return fmt.Errorf("reload: update DNS rule: %w", err)
+		}
+		m.log.Info("DNS rule updated from reload")
+	}
+
+	if m.proxy != nil {
+		m.proxy.updateRouter(m.config.DNSProxy, m.config.Domains, m.config.Nameservers)
+		m.log.Info("DNS proxy router updated from reload")
+	}
+
+	if old.Server != m.config.Server {
+		m.log.Info("server changed, restarting WSL process", "old", old.Server, "new", m.config.Server)
+		m.stopWSLProcess()
+		m.waitWSLExit(5 * time.Second)
+		if err := m.startWSLProcess(); err != nil {
+			return fmt.Errorf("reload: restart WSL process: %w", err)
+		}
+	}
+	return nil
+}
+
+func stringSlicesEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
 	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
 }
 
-func run(yamlPath string) error {
-	svc := &myService{yamlPath: yamlPath}
+func run(yamlPath string, opts runOpts, logCfg LogConfig) error {
+	logger, err := newLogger(logCfg)
+	if err != nil {
+		return err
+	}
+
+	svc := &myService{yamlPath: yamlPath, log: logger, opts: opts}
 
 	if err := svc.loadConfig(); err != nil {
 		return fmt.Errorf("load config: %w", err)
@@ -255,36 +464,59 @@ func run(yamlPath string) error {
 	if err := svc.validateConfig(); err != nil {
 		return err
 	}
-	if err := svc.addDNSRule(); err != nil {
-		return fmt.Errorf("add DNS rule: %w", err)
+
+	if svc.config.Metrics != nil {
+		metrics, err := newMetricsServer(svc.config.Metrics, logger)
+		if err != nil {
+			return fmt.Errorf("metrics config: %w", err)
+		}
+		if err := metrics.Start(svc.config.Metrics.Listen); err != nil {
+			return fmt.Errorf("start metrics server: %w", err)
+		}
+		defer metrics.Stop()
+		svc.metrics = metrics
+	}
+
+	var proxy *DNSProxy
+	if svc.config.DNSProxy != nil {
+		proxy = newDNSProxy(svc.config.DNSProxy, svc.config.Domains, svc.config.Nameservers, logger)
+		if err := proxy.Start(svc.config.DNSProxy.Listen); err != nil {
+			return fmt.Errorf("start dns proxy: %w", err)
+		}
+		defer proxy.Stop()
+		svc.proxy = proxy
+	} else if opts.DNSProxyOnly {
+		return fmt.Errorf("--dns-proxy-only requires a dns_proxy: block in the config")
+	}
+
+	if !opts.DNSProxyOnly {
+		if err := svc.addDNSRule(); err != nil {
+			return fmt.Errorf("add DNS rule: %w", err)
+		}
 	}
 	if err := svc.startWSLProcess(); err != nil {
 		return fmt.Errorf("start WSL process: %w", err)
 	}
 
-	log.Println("Running. Press Ctrl+C to stop.")
+	// Interactive/non-service mode has no Windows-compatible reload signal
+	// (os/signal on Windows only ever delivers os.Interrupt for Ctrl+C/Break
+	// and syscall.SIGTERM for a logoff/shutdown close; there is no SIGHUP).
+	// Config reload is only available through the named-pipe "reload"
+	// command, which requires running as the Windows service.
+	logger.Info("running, press Ctrl+C to stop")
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 	<-sigChan
-	log.Println("Stopping...")
+	logger.Info("stopping")
 	signal.Stop(sigChan)
 
 	svc.stopWSLProcess()
-	svc.removeDNSRule()
+	if !opts.DNSProxyOnly {
+		svc.removeDNSRule()
+	}
 	svc.waitWSLExit(5 * time.Second)
 
-	log.Println("Stopped.")
+	logger.Info("stopped")
 	return nil
 }
-
-func main() {
-	if len(os.Args) != 2 {
-		log.Fatalf("Usage: %s <config.yaml>", os.Args[0])
-	}
-	yamlPath := os.Args[1]
-	if err := run(yamlPath); err != nil {
-		log.Printf("Error: %v", err)
-		os.Exit(1)
-	}
-}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Microsoft/go-winio"
+	"github.com/hashicorp/go-hclog"
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+)
+
+const (
+	defaultRetryLimit = 5
+	backoffBase       = 2 * time.Second
+	backoffMax        = 2 * time.Minute
+)
+
+// windowsServiceHandler implements svc.Handler. It owns the supervised
+// myService/DNSProxy instance, restarts the WSL process with exponential
+// backoff on unexpected exit, and serves the named-pipe control channel.
+type windowsServiceHandler struct {
+	yamlPath string
+	opts     runOpts
+	logCfg   LogConfig
+	log      hclog.Logger
+	elog     *eventlog.Log
+
+	mu        sync.Mutex
+	current   *myService
+	proxy     *DNSProxy
+	metrics   *metricsServer
+	lastAuth  string
+	lastState string
+
+	// restarting is set while reload() or switchProfile() is intentionally
+	// stopping/starting the WSL process, so supervise() doesn't mistake the
+	// resulting exit for a crash.
+	restarting atomic.Bool
+}
+
+func runAsService(yamlPath string, opts runOpts, logCfg LogConfig) error {
+	logger, err := newLogger(logCfg)
+	if err != nil {
+		return err
+	}
+
+	h := &windowsServiceHandler{yamlPath: yamlPath, opts: opts, logCfg: logCfg, log: logger, lastState: "starting"}
+
+	if elog, err := eventlog.Open(serviceName); err == nil {
+		h.elog = elog
+		defer elog.Close()
+	} else {
+		logger.Warn("failed to open Windows Event Log, continuing without it", "error", err)
+	}
+
+	return svc.Run(serviceName, h)
+}
+
+func (h *windowsServiceHandler) eventLog(level hclog.Level, msg string) {
+	if h.elog == nil {
+		return
+	}
+	switch {
+	case level >= hclog.Error:
+		_ = h.elog.Error(1, msg)
+	case level >= hclog.Warn:
+		_ = h.elog.Warning(1, msg)
+	default:
+		_ = h.elog.Info(1, msg)
+	}
+}
+
+// Execute implements svc.Handler. It is invoked by the Windows service
+// control manager after svc.Run registers the service.
+func (h *windowsServiceHandler) Execute(args []string, r <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
+	const accepts = svc.AcceptStop | svc.AcceptShutdown | svc.AcceptSessionChange
+
+	changes <- svc.Status{State: svc.StartPending}
+
+	stopCh := make(chan struct{})
+	doneCh := make(chan struct{})
+	go h.supervise(stopCh, doneCh)
+
+	pipeStopCh := make(chan struct{})
+	go h.servePipe(pipeStopCh)
+
+	changes <- svc.Status{State: svc.Running, Accepts: accepts}
+	h.setState("running")
+	h.eventLog(hclog.Info, "service started")
+
+loop:
+	for {
+		req := <-r
+		switch req.Cmd {
+		case svc.Interrogate:
+			changes <- req.CurrentStatus
+		case svc.Stop, svc.Shutdown:
+			changes <- svc.Status{State: svc.StopPending}
+			close(stopCh)
+			close(pipeStopCh)
+			<-doneCh
+			break loop
+		case svc.SessionChange:
+			if req.EventType == windows.WTS_SESSION_LOGON {
+				h.log.Info("session logon detected, reapplying DNS rule", "event", "session_logon")
+				go h.reapplyDNSRule()
+			}
+		}
+	}
+
+	h.eventLog(hclog.Info, "service stopped")
+	changes <- svc.Status{State: svc.Stopped}
+	return false, 0
+}
+
+func (h *windowsServiceHandler) setState(state string) {
+	h.mu.Lock()
+	h.lastState = state
+	h.mu.Unlock()
+}
+
+// supervise runs the WSL process in a loop, restarting it with exponential
+// backoff whenever it exits unexpectedly or fails to start, until stopCh is
+// closed. The attempt count, which sets both the backoff delay and the
+// opts.RetryLimit cap, resets each time the process starts successfully, so
+// the cap bounds consecutive failed restarts rather than the total.
+func (h *windowsServiceHandler) supervise(stopCh <-chan struct{}, doneCh chan<- struct{}) {
+	defer close(doneCh)
+
+	attempt := 0
+	for {
+		svcInst := &myService{yamlPath: h.yamlPath, log: h.log, opts: h.opts}
+		svcInst.onAuthURL = func(url string) {
+			h.mu.Lock()
+			h.lastAuth = url
+			h.mu.Unlock()
+		}
+		if err := h.startOnce(svcInst); err != nil {
+			h.log.Error("failed to start WSL process", "attempt", attempt, "error", err)
+			h.eventLog(hclog.Error, fmt.Sprintf("failed to start WSL process: %v", err))
+		} else {
+			attempt = 0
+			h.mu.Lock()
+			h.current = svcInst
+			h.mu.Unlock()
+
+			final, crashed := h.watch(stopCh, svcInst)
+			if !crashed {
+				return
+			}
+			h.log.Warn("WSL process exited unexpectedly, will restart", "attempt", attempt)
+			h.mu.Lock()
+			metrics := h.metrics
+			h.mu.Unlock()
+			if metrics != nil {
+				metrics.markRestarted()
+			}
+
+			if !h.opts.DNSProxyOnly {
+				final.removeDNSRule()
+			}
+			h.stopProxy()
+		}
+
+		attempt++
+		if h.opts.RetryLimit > 0 && attempt > h.opts.RetryLimit {
+			h.log.Error("retry limit exceeded, giving up", "retry_limit", h.opts.RetryLimit)
+			h.eventLog(hclog.Error, "retry limit exceeded, service giving up on WSL process")
+			return
+		}
+
+		delay := backoffBase * time.Duration(1<<uint(attempt-1))
+		if delay > backoffMax {
+			delay = backoffMax
+		}
+		select {
+		case <-stopCh:
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// watch blocks until svcInst's WSL process exits or stopCh closes. A close
+// of svcInst.wslExitCh while h.restarting is set comes from reload() or
+// switchProfile() intentionally cycling the process (switchProfile may also
+// replace h.current with a different *myService entirely) - watch follows
+// that through by waiting for the restart to finish and picking up
+// whichever instance is current, rather than reporting a crash. It returns
+// the instance that was actually running when it returned, and whether that
+// instance exited unexpectedly (true) or stopCh closed (false).
+func (h *windowsServiceHandler) watch(stopCh <-chan struct{}, svcInst *myService) (*myService, bool) {
+	for {
+		select {
+		case <-stopCh:
+			svcInst.stopWSLProcess()
+			if !h.opts.DNSProxyOnly {
+				svcInst.removeDNSRule()
+			}
+			h.stopProxy()
+			return svcInst, false
+		case <-svcInst.wslExitCh:
+			if !h.restarting.Load() {
+				return svcInst, true
+			}
+			h.log.Info("WSL process restarting intentionally (reload or profile switch), continuing supervision")
+			for h.restarting.Load() {
+				select {
+				case <-stopCh:
+					return svcInst, false
+				case <-time.After(50 * time.Millisecond):
+				}
+			}
+			h.mu.Lock()
+			svcInst = h.current
+			h.mu.Unlock()
+		}
+	}
+}
+
+func (h *windowsServiceHandler) startOnce(svcInst *myService) error {
+	if err := svcInst.loadConfig(); err != nil {
+		return fmt.Errorf("load config: %w", err)
+	}
+	if err := svcInst.validateConfig(); err != nil {
+		return err
+	}
+
+	if err := h.attachMetrics(svcInst); err != nil {
+		return err
+	}
+
+	if svcInst.config.DNSProxy != nil {
+		proxy := newDNSProxy(svcInst.config.DNSProxy, svcInst.config.Domains, svcInst.config.Nameservers, h.log)
+		if err := proxy.Start(svcInst.config.DNSProxy.Listen); err != nil {
+			return fmt.Errorf("start dns proxy: %w", err)
+		}
+		h.mu.Lock()
+		h.proxy = proxy
+		h.mu.Unlock()
+		svcInst.proxy = proxy
+	} else if h.opts.DNSProxyOnly {
+		return fmt.Errorf("--dns-proxy-only requires a dns_proxy: block in the config")
+	}
+
+	if !h.opts.DNSProxyOnly {
+		if err := svcInst.addDNSRule(); err != nil {
+			h.stopProxy()
+			return fmt.Errorf("add DNS rule: %w", err)
+		}
+	}
+	return svcInst.startWSLProcess()
+}
+
+// attachMetrics wires svcInst.metrics to the handler's shared metrics
+// server, creating and starting the server on first use. Both startOnce and
+// switchProfile route new myService instances through this so every
+// instance's WSL exit channel and stream events reach the same /metrics,
+// /healthz, and /readyz endpoints.
+func (h *windowsServiceHandler) attachMetrics(svcInst *myService) error {
+	if svcInst.config.Metrics == nil {
+		return nil
+	}
+	h.mu.Lock()
+	metrics := h.metrics
+	h.mu.Unlock()
+	if metrics == nil {
+		var err error
+		metrics, err = newMetricsServer(svcInst.config.Metrics, h.log)
+		if err != nil {
+			return fmt.Errorf("metrics config: %w", err)
+		}
+		if err := metrics.Start(svcInst.config.Metrics.Listen); err != nil {
+			return fmt.Errorf("start metrics server: %w", err)
+		}
+		h.mu.Lock()
+		h.metrics = metrics
+		h.mu.Unlock()
+	}
+	svcInst.metrics = metrics
+	return nil
+}
+
+func (h *windowsServiceHandler) stopProxy() {
+	h.mu.Lock()
+	proxy := h.proxy
+	h.proxy = nil
+	h.mu.Unlock()
+	if proxy != nil {
+		proxy.Stop()
+	}
+}
+
+// reapplyDNSRule re-runs addDNSRule for the currently running instance.
+// NRPT scope is tied to the logon session, so it can be reset by a
+// SessionChange logon event (fast user switching, RDP reconnect, etc.).
+func (h *windowsServiceHandler) reapplyDNSRule() {
+	h.mu.Lock()
+	svcInst := h.current
+	h.mu.Unlock()
+	if svcInst == nil || h.opts.DNSProxyOnly {
+		return
+	}
+	if err := svcInst.addDNSRule(); err != nil {
+		h.log.Error("failed to reapply DNS rule after session logon", "error", err)
+	}
+}
+
+// servePipe runs the named-pipe control channel that a companion CLI uses
+// to query state, force a reconnect, or trigger the auth URL to reopen.
+func (h *windowsServiceHandler) servePipe(stopCh <-chan struct{}) {
+	listener, err := winio.ListenPipe(namedPipePath, nil)
+	if err != nil {
+		h.log.Error("failed to open control pipe", "pipe", namedPipePath, "error", err)
+		return
+	}
+	defer listener.Close()
+
+	go func() {
+		<-stopCh
+		listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go h.handlePipeConn(conn)
+	}
+}
+
+func (h *windowsServiceHandler) handlePipeConn(conn net.Conn) {
+	defer conn.Close()
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return
+	}
+	_, _ = conn.Write([]byte(h.handlePipeCommand(line) + "\n"))
+}
+
+func (h *windowsServiceHandler) handlePipeCommand(raw string) string {
+	line := trimNewline(raw)
+	cmd, arg, _ := strings.Cut(line, " ")
+
+	switch cmd {
+	case "status":
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		running := h.current != nil
+		return fmt.Sprintf("state=%s running=%t last_auth_url=%s", h.lastState, running, h.lastAuth)
+	case "reconnect":
+		h.mu.Lock()
+		svcInst := h.current
+		h.mu.Unlock()
+		if svcInst == nil {
+			return "error: not running"
+		}
+		svcInst.stopWSLProcess()
+		return "ok: reconnecting"
+	case "reopen-auth":
+		h.mu.Lock()
+		svcInst := h.current
+		url := h.lastAuth
+		h.mu.Unlock()
+		if svcInst == nil || url == "" {
+			return "error: no auth url available"
+		}
+		svcInst.reopenAuthURL(url)
+		return "ok: reopened " + url
+	case "reload":
+		h.mu.Lock()
+		svcInst := h.current
+		h.mu.Unlock()
+		if svcInst == nil {
+			return "error: not running"
+		}
+		h.restarting.Store(true)
+		err := svcInst.reload()
+		h.restarting.Store(false)
+		if err != nil {
+			return "error: " + err.Error()
+		}
+		return "ok: reloaded"
+	case "switch-profile":
+		if arg == "" {
+			return "error: switch-profile requires a profile name"
+		}
+		if err := h.switchProfile(arg); err != nil {
+			return "error: " + err.Error()
+		}
+		return "ok: switched to " + arg
+	default:
+		return "error: unknown command"
+	}
+}
+
+// switchProfile atomically reconnects to a different profile's VPN
+// endpoint: it stages an NRPT rule for the new domains under a temporary
+// name (so resolution for the new domains works immediately), brings the
+// old tunnel down and the new one up, then promotes the staged rule to the
+// real display name and drops the temporary one. A rule matching the new
+// domains exists throughout, so there's no DNS gap.
+func (h *windowsServiceHandler) switchProfile(name string) error {
+	raw, err := loadRawConfig(h.yamlPath)
+	if err != nil {
+		return fmt.Errorf("load config: %w", err)
+	}
+	newCfg, err := resolveProfile(raw, name)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	old := h.current
+	h.mu.Unlock()
+	if old == nil {
+		return fmt.Errorf("no active instance to switch from")
+	}
+
+	stagedName := dnsRuleDisplayName + " (switching)"
+	if !h.opts.DNSProxyOnly {
+		if err := addNRPTRule(stagedName, newCfg.Domains, newCfg.Nameservers); err != nil {
+			return fmt.Errorf("stage new DNS rule: %w", err)
+		}
+	}
+
+	h.restarting.Store(true)
+	defer h.restarting.Store(false)
+
+	old.stopWSLProcess()
+	old.waitWSLExit(5 * time.Second)
+
+	newInst := &myService{yamlPath: h.yamlPath, log: h.log, opts: h.opts, config: newCfg}
+	newInst.opts.Profile = name
+	newInst.onAuthURL = old.onAuthURL
+	newInst.proxy = old.proxy
+	if err := h.attachMetrics(newInst); err != nil {
+		return fmt.Errorf("attach metrics: %w", err)
+	}
+	if err := newInst.startWSLProcess(); err != nil {
+		return fmt.Errorf("start new WSL process: %w", err)
+	}
+
+	if !h.opts.DNSProxyOnly {
+		if output, err := removeNRPTRule(dnsRuleDisplayName); err != nil {
+			h.log.Warn("failed to remove old DNS rule during profile switch", "error", err, "output", string(output))
+		}
+		if err := addNRPTRule(dnsRuleDisplayName, newCfg.Domains, newCfg.Nameservers); err != nil {
+			return fmt.Errorf("promote new DNS rule: %w", err)
+		}
+		if output, err := removeNRPTRule(stagedName); err != nil {
+			h.log.Warn("failed to remove staged DNS rule", "error", err, "output", string(output))
+		}
+	}
+
+	h.mu.Lock()
+	h.current = newInst
+	h.opts.Profile = name
+	h.mu.Unlock()
+
+	h.log.Info("switched profile", "profile", name)
+	return nil
+}
+
+func trimNewline(s string) string {
+	for len(s) > 0 && (s[len(s)-1] == '\n' || s[len(s)-1] == '\r') {
+		s = s[:len(s)-1]
+	}
+	return s
+}